@@ -0,0 +1,173 @@
+package plan
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"sourcegraph.com/sourcegraph/makex"
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/buildstore"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// casIndexFileName is the name of the per-commit index file that maps
+// source units to the content hash of their most recently published
+// build output.
+const casIndexFileName = "cas-index.json"
+
+// casIndex maps a source unit's cache key (see unitCacheKey) to the
+// content hash of its published build output.
+type casIndex map[string]string
+
+// unitInputHash computes a stable, content-addressable hash for u's
+// inputs: the sorted list of its source files keyed by SHA-256 content
+// digest, the toolchain image/tag that will execute the rule, and the
+// unit's config. Two units with identical inputs hash the same
+// regardless of which commit, branch, or repository they came from, so
+// build outputs can be shared across unrelated commits.
+//
+// Only u.Config is hashed, not the whole SourceUnit: fields like
+// CachedRev are commit-specific bookkeeping, and hashing them would make
+// the result vary per commit even when the actual inputs haven't
+// changed, defeating the point of content-addressing.
+//
+// toolchainContainer identifies the exact image/tag that will execute
+// u's toolchain (see toolchain.Toolchain.Info), not Options.ToolchainExecOpt:
+// ToolchainExecOpt only says how the toolchain is invoked (program, docker,
+// vm), which is the same for every unit and doesn't change across a
+// toolchain upgrade, so hashing it would keep serving stale cached output
+// after the toolchain image that actually produced it changes.
+// CreateMakefile passes Options.ToolchainExecOpt here only when
+// Options.ToolchainVersion is nil, in which case that staleness applies.
+func unitInputHash(u *unit.SourceUnit, toolchainContainer string) (string, error) {
+	h := sha256.New()
+
+	files := append([]string{}, u.Files...)
+	sort.Strings(files)
+	for _, f := range files {
+		fh, err := fileContentHash(f)
+		if err != nil {
+			return "", fmt.Errorf("hashing %s: %s", f, err)
+		}
+		fmt.Fprintf(h, "file %s %s\n", f, fh)
+	}
+
+	fmt.Fprintf(h, "toolchain %s\n", toolchainContainer)
+
+	cfg, err := json.Marshal(u.Config)
+	if err != nil {
+		return "", err
+	}
+	h.Write(cfg)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileContentHash(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// casPath returns the path, relative to the build store root, at which
+// the build output for the given content hash is (or would be) stored.
+func casPath(hash string) string {
+	return path.Join("cas", "sha256", hash[:2], hash[2:])
+}
+
+// buildStoreURI returns the rwvfs URI that recipes should resolve
+// buildStore-relative paths (like casPath(hash)) against. vfs is the
+// rwvfs.FileSystem backing buildStore - rwvfs.OS (a local path, the
+// common case), rwvfs.Map (tests), rwvfs.HTTP (an already-built commit's
+// data served by a Sourcegraph server), or an rwvfs.Union of a local
+// overlay over a remote store - all of which implement fmt.Stringer with
+// a URI-shaped String().
+//
+// vfs is passed in explicitly (via Options.BuildStoreVFS) rather than
+// recovered from buildStore by type assertion: buildstore.RepoBuildStore
+// doesn't expose the rwvfs.FileSystem backing it, so there's no portable
+// way to ask an arbitrary RepoBuildStore for its URI. If vfs is nil, this
+// falls back to a plain local path, which is only correct when buildStore
+// is in fact backed by the local filesystem at ".".
+func buildStoreURI(vfs rwvfs.FileSystem) string {
+	if vfs == nil {
+		return "file://."
+	}
+	return vfs.String()
+}
+
+// vfsJoin appends relPath to the vfs-uri base, the way "src fetch --from"
+// expects: base identifies the filesystem/root, and the full fetch
+// source is base+relPath.
+func vfsJoin(base, relPath string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(relPath, "/")
+}
+
+// unitCacheKey identifies a source unit independent of the commit it was
+// analyzed at, for use as a casIndex key.
+func unitCacheKey(u *unit.SourceUnit) string {
+	return u.Type + "/" + u.Name
+}
+
+// readCASIndex reads the CAS index for commitID, returning an empty
+// index (not an error) if none has been published yet.
+func readCASIndex(buildStore buildstore.RepoBuildStore, commitID string) (casIndex, error) {
+	idx := make(casIndex)
+
+	f, err := buildStore.Open(path.Join(commitID, casIndexFileName))
+	if os.IsNotExist(err) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// writeCASIndex publishes the CAS index for commitID so that `list` and
+// `import` can still resolve a unit's build output by commit rather than
+// by content hash.
+func writeCASIndex(buildStore buildstore.RepoBuildStore, commitID string, idx casIndex) error {
+	f, err := buildStore.Create(path.Join(commitID, casIndexFileName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewEncoder(f).Encode(idx)
+}
+
+// casPublishingRule wraps a rule that has to actually run (no cache hit,
+// local or remote), appending a recipe that copies its output into the
+// CAS, at casPath(hash) in buildStore's backing store, once the rule's
+// own recipes succeed. Without this, nothing ever writes to casPath and
+// the cachedRule branch in CreateMakefile can never hit.
+type casPublishingRule struct {
+	makex.Rule
+	vfs  rwvfs.FileSystem
+	hash string
+}
+
+func (r *casPublishingRule) Recipes() []string {
+	dest := vfsJoin(buildStoreURI(r.vfs), casPath(r.hash))
+	return append(r.Rule.Recipes(), fmt.Sprintf("src cache publish %s --to %s", r.Rule.Target(), dest))
+}
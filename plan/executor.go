@@ -0,0 +1,303 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"sourcegraph.com/sourcegraph/makex"
+)
+
+// pseudoTargets are targets CreateMakefile appends to satisfy makex's
+// Makefile format - an aggregate "all" target and the .DELETE_ON_ERROR
+// special target - neither of which is a real build output. Executor
+// runs rules directly instead of invoking make, so these aren't
+// scheduled as rules: nothing depends on "all", and DELETE_ON_ERROR's
+// behavior is emulated directly in runOne instead of relying on make to
+// heed it.
+var pseudoTargets = map[string]bool{
+	"all":              true,
+	".DELETE_ON_ERROR": true,
+}
+
+// ExecOptions configures an Executor.
+type ExecOptions struct {
+	// Concurrency is the maximum number of rules to run at once (the -j
+	// flag). If 0, it defaults to runtime.NumCPU().
+	Concurrency int
+
+	// Stdout and Stderr receive each rule's recipe output as the recipe
+	// writes it. The output is not prefixed with the rule's target, so
+	// output of rules running at the same time can interleave. If nil,
+	// output is discarded.
+	Stdout, Stderr io.Writer
+
+	// Progress, if set, is called with a structured event each time a
+	// rule starts or finishes, so callers (e.g. a TUI) can render live
+	// status. Events are also safe to marshal as JSON progress lines.
+	Progress func(Event)
+}
+
+// Event describes a rule transitioning between states during an
+// Executor run.
+type Event struct {
+	Target   string        `json:"target"`
+	Status   EventStatus   `json:"status"`
+	Err      string        `json:"error,omitempty"`
+	Duration time.Duration `json:"durationNs,omitempty"`
+}
+
+// EventStatus is the lifecycle state reported in an Event.
+type EventStatus string
+
+const (
+	EventStart EventStatus = "start"
+	EventDone  EventStatus = "done"
+	EventError EventStatus = "error"
+)
+
+// Executor runs a set of makex.Rules directly, on a worker pool, without
+// generating and invoking a Makefile. It builds a dependency graph from
+// each rule's Target()/Prereqs(), schedules rules topologically, skips a
+// rule whose target is already at least as new as all of its prereqs
+// (mirroring make's own staleness check, which running rules directly
+// instead of through make otherwise loses), and cancels remaining work
+// on the first error.
+type Executor struct {
+	opt ExecOptions
+
+	byTarget map[string]makex.Rule
+	deps     map[string][]string // target -> prereq targets that are also rule targets
+}
+
+// NewExecutor prepares an Executor for rules. Rules with the same target
+// are deduplicated, keeping the first occurrence (mirroring make's
+// semantics for duplicate rules).
+func NewExecutor(rules []makex.Rule, opt ExecOptions) *Executor {
+	if opt.Concurrency == 0 {
+		opt.Concurrency = runtime.NumCPU()
+	}
+
+	byTarget := make(map[string]makex.Rule, len(rules))
+	for _, r := range rules {
+		if pseudoTargets[r.Target()] {
+			continue
+		}
+		if _, ok := byTarget[r.Target()]; ok {
+			continue
+		}
+		byTarget[r.Target()] = r
+	}
+
+	deps := make(map[string][]string, len(byTarget))
+	for target, r := range byTarget {
+		for _, p := range r.Prereqs() {
+			if _, isRuleTarget := byTarget[p]; isRuleTarget {
+				deps[target] = append(deps[target], p)
+			}
+		}
+	}
+
+	return &Executor{opt: opt, byTarget: byTarget, deps: deps}
+}
+
+// Run executes all rules, respecting dependency order and the configured
+// concurrency, stopping remaining work as soon as one rule's recipe
+// fails. It returns the first error encountered, if any.
+func (e *Executor) Run() error {
+	var (
+		mu       sync.Mutex
+		done     = make(map[string]bool, len(e.byTarget))
+		firstErr error
+		failed   bool
+	)
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, e.opt.Concurrency)
+
+	running := make(map[string]bool, len(e.byTarget))
+
+	// readyLocked returns not-yet-running targets whose prereqs are all
+	// done. Callers must hold mu.
+	readyLocked := func() []string {
+		var targets []string
+		for target := range e.byTarget {
+			if done[target] || running[target] {
+				continue
+			}
+			satisfied := true
+			for _, dep := range e.deps[target] {
+				if !done[dep] {
+					satisfied = false
+					break
+				}
+			}
+			if satisfied {
+				targets = append(targets, target)
+			}
+		}
+		return targets
+	}
+
+	var scheduleNext func()
+	scheduleNext = func() {
+		mu.Lock()
+		if failed {
+			mu.Unlock()
+			return
+		}
+		targets := readyLocked()
+		for _, target := range targets {
+			running[target] = true
+		}
+		mu.Unlock()
+
+		// sem is acquired outside mu: with Concurrency rules already in
+		// flight, this blocks until one finishes and releases its slot,
+		// which happens in the goroutine below *before* it calls
+		// scheduleNext again. Acquiring it while holding mu would
+		// deadlock, since the in-flight goroutines need mu themselves to
+		// record completion.
+		for _, target := range targets {
+			mu.Lock()
+			stop := failed
+			mu.Unlock()
+			if stop {
+				return
+			}
+
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(target string) {
+				defer wg.Done()
+
+				err := e.runOne(target)
+
+				mu.Lock()
+				done[target] = true
+				if err != nil && !failed {
+					failed = true
+					firstErr = err
+				}
+				mu.Unlock()
+
+				<-sem
+				scheduleNext()
+			}(target)
+		}
+	}
+
+	scheduleNext()
+	wg.Wait()
+
+	if firstErr == nil {
+		if stuck := e.stuckTargets(done); len(stuck) > 0 {
+			return fmt.Errorf("plan: %d target(s) never became ready, likely a dependency cycle: %s", len(stuck), strings.Join(stuck, ", "))
+		}
+	}
+
+	return firstErr
+}
+
+// stuckTargets returns the targets that never ran, in sorted order. Run
+// calls this once scheduling has quiesced (wg.Wait returned with no
+// targets in flight): if the graph has a cycle, or a target depends on
+// one that can never become ready, scheduleNext's dependency-satisfied
+// check never admits it, so it's simply never scheduled - and unlike a
+// failed recipe, that leaves no error for Run to report on its own.
+func (e *Executor) stuckTargets(done map[string]bool) []string {
+	if len(done) == len(e.byTarget) {
+		return nil
+	}
+	var stuck []string
+	for target := range e.byTarget {
+		if !done[target] {
+			stuck = append(stuck, target)
+		}
+	}
+	sort.Strings(stuck)
+	return stuck
+}
+
+func (e *Executor) runOne(target string) error {
+	rule := e.byTarget[target]
+
+	if upToDate(target, rule.Prereqs()) {
+		// Nothing has changed since target was last built (or fetched):
+		// skip re-running its recipes entirely. Without this, every rule
+		// in the set - including every unaffected unit's cachedRule, whose
+		// "recipe" just re-fetches an output that's already sitting at
+		// target - spawns a subprocess on every run, which is what makes
+		// re-running the full rule set on each Watch event prohibitively
+		// slow on repos with more than a handful of units.
+		e.report(Event{Target: target, Status: EventDone})
+		return nil
+	}
+
+	start := time.Now()
+	e.report(Event{Target: target, Status: EventStart})
+
+	for _, recipe := range rule.Recipes() {
+		cmd := exec.Command("sh", "-c", recipe)
+		cmd.Stdout = e.opt.Stdout
+		cmd.Stderr = e.opt.Stderr
+		if err := cmd.Run(); err != nil {
+			// Emulate make's .DELETE_ON_ERROR: don't leave a partially
+			// written target around to be mistaken for a valid cache
+			// entry on the next run. Best-effort; target may not be a
+			// plain file (or may not have been created at all).
+			os.Remove(target)
+
+			err = fmt.Errorf("target %s: recipe %q: %s", target, recipe, err)
+			e.report(Event{Target: target, Status: EventError, Err: err.Error(), Duration: time.Since(start)})
+			return err
+		}
+	}
+
+	e.report(Event{Target: target, Status: EventDone, Duration: time.Since(start)})
+	return nil
+}
+
+// upToDate reports whether target exists and is at least as new as every
+// prereq (source files, and rule targets already built earlier in this
+// or a previous Run, which are compared by modification time like any
+// other file). A prereq that can't be stat'd - one that doesn't exist on
+// disk - is treated as making target stale, the safe default.
+func upToDate(target string, prereqs []string) bool {
+	ti, err := os.Stat(target)
+	if err != nil {
+		return false
+	}
+	for _, p := range prereqs {
+		pi, err := os.Stat(p)
+		if err != nil || pi.ModTime().After(ti.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Executor) report(ev Event) {
+	if e.opt.Progress != nil {
+		e.opt.Progress(ev)
+	}
+}
+
+// JSONProgress returns a Progress func that writes each Event to w as a
+// line of JSON, suitable for piping to a TUI or log aggregator.
+func JSONProgress(w io.Writer) func(Event) {
+	enc := json.NewEncoder(w)
+	var mu sync.Mutex
+	return func(ev Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(ev)
+	}
+}
@@ -0,0 +1,120 @@
+package plan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/makex"
+)
+
+// fakeRule is a minimal makex.Rule for exercising Executor without a real
+// toolchain: its recipes are plain shell commands operating on files
+// under a test's temp dir.
+type fakeRule struct {
+	target  string
+	prereqs []string
+	recipes []string
+}
+
+func (r *fakeRule) Target() string    { return r.target }
+func (r *fakeRule) Prereqs() []string { return r.prereqs }
+func (r *fakeRule) Recipes() []string { return r.recipes }
+
+var _ makex.Rule = (*fakeRule)(nil)
+
+// writeRule returns a fakeRule whose single recipe creates target by
+// concatenating the contents of prereqs. If any prereq doesn't exist yet
+// - i.e. it hasn't been built - the recipe (and so the rule) fails, which
+// is what lets TestExecutor_Diamond detect a scheduling-order bug: a
+// child run before its parents would fail to read a prereq that doesn't
+// exist yet.
+func writeRule(target string, prereqs ...string) *fakeRule {
+	recipe := fmt.Sprintf("echo %s > %s", target, target)
+	if len(prereqs) > 0 {
+		recipe = fmt.Sprintf("cat %s > %s", strings.Join(prereqs, " "), target)
+	}
+	return &fakeRule{target: target, prereqs: prereqs, recipes: []string{recipe}}
+}
+
+func TestExecutor_Diamond(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor-diamond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	c := filepath.Join(dir, "c")
+	d := filepath.Join(dir, "d")
+
+	rules := []makex.Rule{
+		writeRule(a),
+		writeRule(b, a),
+		writeRule(c, a),
+		writeRule(d, b, c),
+	}
+
+	if err := NewExecutor(rules, ExecOptions{}).Run(); err != nil {
+		t.Fatalf("Run() = %s, want nil", err)
+	}
+
+	for _, target := range []string{a, b, c, d} {
+		if _, err := os.Stat(target); err != nil {
+			t.Errorf("target %s was not built: %s", target, err)
+		}
+	}
+}
+
+func TestExecutor_FailureStopsDownstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor-failure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+
+	rules := []makex.Rule{
+		&fakeRule{target: a, recipes: []string{"exit 1"}},
+		writeRule(b, a),
+	}
+
+	err = NewExecutor(rules, ExecOptions{}).Run()
+	if err == nil {
+		t.Fatal("Run() = nil, want an error from the failing rule")
+	}
+
+	if _, statErr := os.Stat(b); statErr == nil {
+		t.Errorf("target %s was built despite its prereq %s failing", b, a)
+	}
+}
+
+func TestExecutor_CycleErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "executor-cycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+
+	rules := []makex.Rule{
+		&fakeRule{target: a, prereqs: []string{b}, recipes: []string{fmt.Sprintf("cat %s > %s", b, a)}},
+		&fakeRule{target: b, prereqs: []string{a}, recipes: []string{fmt.Sprintf("cat %s > %s", a, b)}},
+	}
+
+	err = NewExecutor(rules, ExecOptions{}).Run()
+	if err == nil {
+		t.Fatal("Run() = nil, want an error for the cyclic rule graph")
+	}
+	if !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Run() error = %q, want it to mention a dependency cycle", err)
+	}
+}
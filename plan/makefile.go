@@ -8,17 +8,50 @@ import (
 	"strings"
 
 	"sourcegraph.com/sourcegraph/makex"
+	"sourcegraph.com/sourcegraph/rwvfs"
 	"sourcegraph.com/sourcegraph/srclib/buildstore"
 	"sourcegraph.com/sourcegraph/srclib/config"
+	"sourcegraph.com/sourcegraph/srclib/plan/vcs"
 	"sourcegraph.com/sourcegraph/srclib/unit"
 )
 
 type Options struct {
 	ToolchainExecOpt string
 
+	// ToolchainVersion, if set, returns an identifier (e.g. a Docker image
+	// digest) for the exact toolchain build that will execute rules for
+	// the given unit type. It is hashed into a unit's CAS input hash
+	// instead of ToolchainExecOpt, which only says how the toolchain is
+	// invoked (program, docker, vm) and stays the same across a toolchain
+	// upgrade. If nil, the hash falls back to ToolchainExecOpt.
+	ToolchainVersion func(unitType string) (string, error)
+
 	// When NoCache is true, all files are rebuilt instead of only
 	// the ones associated with changed source units.
 	NoCache bool
+
+	// RemoteCache, if set, is consulted for a unit's build output when no
+	// local cache entry exists, and is published to after a unit builds
+	// successfully (unless CacheMode is ReadOnly).
+	RemoteCache RemoteCache
+
+	// CacheMode controls whether RemoteCache may be written to. It has
+	// no effect if RemoteCache is nil.
+	CacheMode CacheMode
+
+	// RepoDir is the working copy root, used to walk revision history
+	// when falling back to the rev-based cache heuristic. If empty, the
+	// fallback heuristic trusts each unit's CachedRev as-is.
+	RepoDir string
+
+	// BuildStoreVFS is the rwvfs.FileSystem backing buildStore, used to
+	// derive the URI that "src fetch"/"src cache publish" recipes resolve
+	// CAS paths against. buildstore.RepoBuildStore doesn't expose its
+	// backing filesystem, so callers that want fetch/publish recipes to
+	// address a non-local store (rwvfs.HTTP, rwvfs.Union, ...) must pass
+	// it here explicitly. If nil, recipes assume buildStore is rooted at
+	// the local path ".".
+	BuildStoreVFS rwvfs.FileSystem
 }
 
 type RuleMaker func(c *config.Tree, dataDir string, existing []makex.Rule, opt Options) ([]makex.Rule, error)
@@ -44,13 +77,16 @@ func RegisterRuleMaker(name string, r RuleMaker) {
 	orderedRuleMakers = append(orderedRuleMakers, r)
 }
 
-// cachedRule is a rule creates the target as a copy of cachedPath. It is
-// meant for files that haven't changed between commits.
+// cachedRule is a rule that creates the target from cachedPath, which is
+// a path within buildStore's backing rwvfs.FileSystem rather than
+// necessarily a local filesystem path. It is meant for files that
+// haven't changed between commits.
 type cachedRule struct {
 	cachedPath string
 	target     string
 	unit       *unit.SourceUnit
 	prereqs    []string
+	vfs        rwvfs.FileSystem
 }
 
 func (r *cachedRule) Target() string {
@@ -62,11 +98,17 @@ func (r *cachedRule) Prereqs() []string {
 }
 
 func (r *cachedRule) Recipes() []string {
+	// src fetch resolves cachedPath against buildStore's backing
+	// rwvfs.FileSystem, which may be rwvfs.OS (a local path, the common
+	// case), rwvfs.Map (tests), rwvfs.HTTP (an already-built commit's
+	// data served by a Sourcegraph server, for CI environments that
+	// don't have .srclib-cache checked out locally), or an rwvfs.Union
+	// of a local overlay over a remote store. This replaces the old
+	// 'cp'-based recipe, which required cachedPath and target to both be
+	// on local disk.
+	from := vfsJoin(buildStoreURI(r.vfs), r.cachedPath)
 	return []string{
-		// The recipe uses 'cp' instead of 'ln -s' to make it more
-		// resilient to things going wrong (like missing the file at
-		// cachedPath).
-		fmt.Sprintf("cp %s %s", r.cachedPath, r.target),
+		fmt.Sprintf("src fetch --from %s %s", from, r.target),
 	}
 }
 
@@ -74,11 +116,90 @@ func (r *cachedRule) SourceUnit() *unit.SourceUnit {
 	return r.unit
 }
 
+// fallbackCachedRule applies the legacy revision-based cache heuristic,
+// used when a unit has no CAS entry for its current inputs. If repo is
+// non-nil, it walks commitID's ancestry to find the nearest ancestor
+// commit that has any build data (whether that data includes this unit
+// is not checked), rather than trusting a single pre-recorded CachedRev;
+// this works for both Git and Mercurial repos (the VCS types vcs.Open
+// supports) via the vcs.Repo interface, instead of the string-based
+// VCS-type branching this logic used to need.
+func fallbackCachedRule(buildStore buildstore.RepoBuildStore, vfs rwvfs.FileSystem, repo vcs.Repo, commitID string, rule makex.Rule, u *unit.SourceUnit, buildDataDir string) makex.Rule {
+	rev := u.CachedRev
+	if repo != nil {
+		if ancestors, err := repo.RevisionAncestors(commitID, 64); err != nil {
+			log.Printf("error listing revision ancestors, falling back to CachedRev: %s", err)
+		} else {
+			for _, a := range ancestors {
+				if exist, _ := buildstore.BuildDataExistsForCommit(buildStore, a); exist {
+					rev = a
+					break
+				}
+			}
+		}
+	}
+	if rev == "" {
+		return rule
+	}
+
+	// The format for p varies based on whether it's prefixed by buildDataDir:
+	// if it is, we simply swap the revision in the file name with the
+	// previous valid revision. If it isn't, we prefix p with
+	// "../[previous-revision]".
+	p := strings.Split(rule.Target(), "/")
+	if len(p) > 2 ||
+		strings.Join(p[0:2], "/") == buildDataDir ||
+		len(p[1]) == 40 { // HACK: Mercurial and Git both use 40-char hashes.
+		// p is prefixed by "data-dir/vcs-commit-id"
+		p[1] = rev
+	} else {
+		p = append([]string{"..", rev}, p...)
+	}
+
+	return &cachedRule{
+		cachedPath: strings.Join(p, "/"),
+		target:     rule.Target(),
+		unit:       u,
+		prereqs:    rule.Prereqs(),
+		vfs:        vfs,
+	}
+}
+
 // CreateMakefile creates the makefiles for the source units in c.
 func CreateMakefile(buildStore buildstore.RepoBuildStore, commitID, vcsType string, c *config.Tree, opt Options) (*makex.Makefile, error) {
 	// TODO(sqs): buildDataDir is hardcoded.
 	buildDataDir := filepath.Join(buildstore.BuildDataDirName, commitID)
 
+	var repo vcs.Repo
+	if opt.RepoDir != "" {
+		r, err := vcs.Open(vcsType, opt.RepoDir)
+		if err != nil {
+			log.Printf("error opening %s repo at %s, falling back to CachedRev: %s", vcsType, opt.RepoDir, err)
+		} else {
+			repo = r
+		}
+	}
+
+	// Prefer content-addressable caching: a unit's build output can be
+	// reused whenever its inputs hash the same, whatever commit, branch,
+	// or repository it came from. This is robust to file renames, branch
+	// switches, shallow clones, and non-Git VCS, where the
+	// revision-based fallback heuristic breaks down. The index is read
+	// once, before any RuleMaker runs, and newIdx starts as a copy of it:
+	// each unit visited below overwrites its own entry with this run's
+	// hash, but a unit that isn't visited this pass (e.g. its RuleMaker
+	// wasn't invoked, or hashing it failed) keeps its previously published
+	// entry instead of silently dropping out of the index.
+	idx, err := readCASIndex(buildStore, commitID)
+	if err != nil {
+		log.Printf("error reading CAS index, rebuilding from scratch: %s", err)
+		idx = make(casIndex)
+	}
+	newIdx := make(casIndex, len(idx))
+	for k, v := range idx {
+		newIdx[k] = v
+	}
+
 	var allRules []makex.Rule
 	for i, r := range orderedRuleMakers {
 		name := ruleMakerNames[i]
@@ -87,33 +208,6 @@ func CreateMakefile(buildStore buildstore.RepoBuildStore, commitID, vcsType stri
 			return nil, fmt.Errorf("rule maker %s: %s", name, err)
 		}
 		if !opt.NoCache {
-			// When cached builds are enabled, we replace all rules whose source unit
-			// hasn't changed between revisions with a rule that copies files from
-			// the ... to the current directory.
-			// Check to see if a previous build exists.
-			var prevRev string
-			var changedFiles []string
-			if revs, err := listRevisions(currentRepo.VCSType, buildstore.BuildDataDirName); err != nil {
-				log.Println("error listing revisions, rebuilding from scratch: %s", err)
-			} else {
-				// Skip HEAD, the first revision in the list.
-				for i := 1; i < len(revs); i++ {
-					if exist, _ := buildstore.BuildDataExistsForCommit(buildStore, revs[i]); !exist {
-						continue
-					}
-					// A build store exists for this commit. Now we need
-					// to get all the changed files between this rev and
-					// the current rev.
-					files, err := changedFilesFromCurrentRev(currentRepo.VCSType, buildstore.BuildDataDirName, revs[i])
-					if err != nil {
-						log.Println("error retriving changed files, rebuilding from scratch: %s", err)
-						break
-					}
-					changedFiles = files
-					prevRev = revs[i]
-				}
-			}
-			// Replace rules.
 			for i, rule := range rules {
 				r, ok := rule.(interface {
 					SourceUnit() *unit.SourceUnit
@@ -122,35 +216,82 @@ func CreateMakefile(buildStore buildstore.RepoBuildStore, commitID, vcsType stri
 					continue
 				}
 				u := r.SourceUnit()
-				if u.CachedRev == "" {
+
+				toolchainVersion := opt.ToolchainExecOpt
+				if opt.ToolchainVersion != nil {
+					v, err := opt.ToolchainVersion(u.Type)
+					if err != nil {
+						log.Printf("error resolving toolchain version for %s, falling back to rev-based cache: %s", unitCacheKey(u), err)
+						rules[i] = fallbackCachedRule(buildStore, opt.BuildStoreVFS, repo, commitID, rule, u, buildDataDir)
+						continue
+					}
+					toolchainVersion = v
+				}
+
+				hash, err := unitInputHash(u, toolchainVersion)
+				if err != nil {
+					log.Printf("error computing input hash for %s, falling back to rev-based cache: %s", unitCacheKey(u), err)
+					rules[i] = fallbackCachedRule(buildStore, opt.BuildStoreVFS, repo, commitID, rule, u, buildDataDir)
 					continue
 				}
+				newIdx[unitCacheKey(u)] = hash
 
-				// The format for p varies based on whether it's prefixed by buildDataDir:
-				// if it is, we simply swap the revision in the file name with the
-				// previous valid revision. If it isn't, we prefix p with
-				// "../[previous-revision]".
-				p := strings.Split(rule.Target(), "/")
-				if len(p) > 2 ||
-					strings.Join(p[0:2], "/") == buildDataDir ||
-					len(p[1]) == 40 { // HACK: Mercurial and Git both use 40-char hashes.
-					// p is prefixed by "data-dir/vcs-commit-id"
-					p[1] = u.CachedRev
-				} else {
-					p = append([]string{"..", u.CachedRev}, p...)
+				if exist, _ := buildstore.BuildDataExistsAtPath(buildStore, casPath(hash)); exist {
+					rules[i] = &cachedRule{
+						cachedPath: casPath(hash),
+						target:     rule.Target(),
+						unit:       u,
+						prereqs:    rule.Prereqs(),
+						vfs:        opt.BuildStoreVFS,
+					}
+					continue
+				}
+
+				if opt.RemoteCache != nil && opt.RemoteCache.Location() == "" {
+					log.Printf("RemoteCache has no reachable Location, ignoring it for %s", unitCacheKey(u))
+				} else if opt.RemoteCache != nil {
+					if ok, err := opt.RemoteCache.Contains(hash); err == nil && ok {
+						rules[i] = &remoteCachedRule{
+							hash:     hash,
+							location: opt.RemoteCache.Location(),
+							target:   rule.Target(),
+							unit:     u,
+							prereqs:  rule.Prereqs(),
+							vfs:      opt.BuildStoreVFS,
+						}
+						continue
+					}
 				}
 
-				rules[i] = &cachedRule{
-					cachedPath: strings.Join(p, "/"),
-					target:     rule.Target(),
-					unit:       u,
-					prereqs:    rule.Prereqs(),
+				// No CAS entry for these inputs, locally or remotely.
+				// Fall back to the old rev-based lookup, for repos that
+				// have a populated rev cache but haven't published to
+				// the CAS.
+				if fallback := fallbackCachedRule(buildStore, opt.BuildStoreVFS, repo, commitID, rule, u, buildDataDir); fallback != rule {
+					rules[i] = fallback
+					continue
+				}
+
+				// The unit has to actually build. Publish its output to
+				// the CAS once built, so later runs (and other units
+				// sharing these inputs) can hit the cachedRule branch
+				// above instead of rebuilding. If a writable remote
+				// cache is also configured, publish there too.
+				rules[i] = &casPublishingRule{Rule: rule, vfs: opt.BuildStoreVFS, hash: hash}
+				if opt.RemoteCache != nil && opt.CacheMode != ReadOnly && opt.RemoteCache.Location() != "" {
+					rules[i] = &uploadingRule{Rule: rules[i], hash: hash, location: opt.RemoteCache.Location()}
 				}
 			}
 		}
 		allRules = append(allRules, rules...)
 	}
 
+	if !opt.NoCache {
+		if err := writeCASIndex(buildStore, commitID, newIdx); err != nil {
+			log.Printf("error writing CAS index: %s", err)
+		}
+	}
+
 	// Add an "all" rule at the very beginning.
 	allTargets := make([]string, len(allRules))
 	for i, rule := range allRules {
@@ -0,0 +1,97 @@
+package plan
+
+import (
+	"fmt"
+	"io"
+
+	"sourcegraph.com/sourcegraph/makex"
+	"sourcegraph.com/sourcegraph/rwvfs"
+	"sourcegraph.com/sourcegraph/srclib/unit"
+)
+
+// RemoteCache is a pluggable backend for sharing build outputs across
+// machines, keyed by the content hash computed by unitInputHash. It lets
+// a developer or CI runner analyzing a repo at commit X skip toolchain
+// execution entirely for units that were already analyzed elsewhere.
+// CreateMakefile consults it only with that content hash; the rev-based
+// fallback (fallbackCachedRule) does not use the RemoteCache, and no key
+// is derived from a unit's CachedRev.
+type RemoteCache interface {
+	// Get returns a reader for the artifact stored under hash. The bool
+	// return is false (with a nil reader and nil error) if no artifact
+	// exists for hash.
+	Get(hash string) (io.ReadCloser, bool, error)
+
+	// Put uploads the artifact read from r under hash.
+	Put(hash string, r io.Reader) error
+
+	// Contains reports whether an artifact exists for hash, without
+	// fetching it.
+	Contains(hash string) (bool, error)
+
+	// Location returns the backend's address, for embedding in a
+	// "src cache fetch"/"src cache put" recipe so that the spawned src
+	// subprocess - which does not share this process's RemoteCache value -
+	// can reach the same backend. It returns "" for backends with no
+	// externally reachable address (e.g. remotecache.InMemory).
+	// CreateMakefile ignores a RemoteCache whose Location is "" and emits
+	// no fetch or upload recipes for it, so such backends are only useful
+	// to callers that use RemoteCache directly.
+	Location() string
+}
+
+// CacheMode controls whether a RemoteCache may be written to.
+type CacheMode int
+
+const (
+	// ReadWrite fetches from and publishes to the remote cache.
+	ReadWrite CacheMode = iota
+
+	// ReadOnly only fetches from the remote cache; it never uploads new
+	// artifacts. This is useful for untrusted CI runners that shouldn't
+	// be allowed to poison the shared cache.
+	ReadOnly
+)
+
+// remoteCachedRule is a rule that fetches its target from a RemoteCache
+// rather than copying it from a local path, for use when a unit's input
+// hash is known to be cached remotely but no local copy exists.
+type remoteCachedRule struct {
+	hash     string
+	location string
+	target   string
+	unit     *unit.SourceUnit
+	prereqs  []string
+	vfs      rwvfs.FileSystem
+}
+
+func (r *remoteCachedRule) Target() string    { return r.target }
+func (r *remoteCachedRule) Prereqs() []string { return r.prereqs }
+
+func (r *remoteCachedRule) Recipes() []string {
+	// The second recipe promotes the fetched artifact into the local CAS
+	// at casPath(hash), the same path casPublishingRule writes to. Without
+	// it, BuildDataExistsAtPath(casPath(hash)) stays false forever, so
+	// every later run would repeat this same remote fetch instead of ever
+	// hitting the fast local cachedRule branch in CreateMakefile.
+	dest := vfsJoin(buildStoreURI(r.vfs), casPath(r.hash))
+	return []string{
+		fmt.Sprintf("src cache fetch --from %s %s %s", r.location, r.hash, r.target),
+		fmt.Sprintf("src cache publish %s --to %s", r.target, dest),
+	}
+}
+
+func (r *remoteCachedRule) SourceUnit() *unit.SourceUnit { return r.unit }
+
+// uploadingRule wraps a rule that has to actually run (no local or
+// remote cache hit), appending a recipe that publishes its output to the
+// configured RemoteCache once the rule's own recipes succeed.
+type uploadingRule struct {
+	makex.Rule
+	hash     string
+	location string
+}
+
+func (r *uploadingRule) Recipes() []string {
+	return append(r.Rule.Recipes(), fmt.Sprintf("src cache put --to %s %s %s", r.location, r.hash, r.Rule.Target()))
+}
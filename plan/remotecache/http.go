@@ -0,0 +1,86 @@
+package remotecache
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTP is a RemoteCache that stores artifacts as objects under a base
+// URL, one GET/HEAD/PUT per hash. It works against a plain HTTP file
+// server as well as S3-style object stores that accept PUT for upload.
+type HTTP struct {
+	// BaseURL is the URL prefix under which artifacts are stored, e.g.
+	// "https://cache.example.com/srclib/". Hashes are appended directly
+	// to it.
+	BaseURL string
+
+	// Client is used to make requests. If nil, http.DefaultClient is
+	// used.
+	Client *http.Client
+}
+
+func (c *HTTP) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+func (c *HTTP) url(hash string) string {
+	return strings.TrimSuffix(c.BaseURL, "/") + "/" + hash
+}
+
+func (c *HTTP) Get(hash string) (io.ReadCloser, bool, error) {
+	resp, err := c.client().Get(c.url(hash))
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, false, fmt.Errorf("remotecache: GET %s: %s", c.url(hash), resp.Status)
+	}
+	return resp.Body, true, nil
+}
+
+func (c *HTTP) Put(hash string, r io.Reader) error {
+	req, err := http.NewRequest("PUT", c.url(hash), r)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("remotecache: PUT %s: %s", c.url(hash), resp.Status)
+	}
+	return nil
+}
+
+// Location returns BaseURL, which a spawned "src" subprocess can use to
+// reach the same cache via the same plain HTTP GET/PUT/HEAD protocol.
+func (c *HTTP) Location() string {
+	return c.BaseURL
+}
+
+func (c *HTTP) Contains(hash string) (bool, error) {
+	resp, err := c.client().Head(c.url(hash))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("remotecache: HEAD %s: %s", c.url(hash), resp.Status)
+	}
+	return true, nil
+}
@@ -0,0 +1,88 @@
+package remotecache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestServer returns a minimal HTTP server implementing the
+// GET/PUT/HEAD protocol that HTTP expects, backed by an in-memory map.
+func newTestServer() *httptest.Server {
+	var mu sync.Mutex
+	data := make(map[string][]byte)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := r.URL.Path[1:]
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.Method {
+		case "GET", "HEAD":
+			b, ok := data[hash]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == "GET" {
+				w.Write(b)
+			}
+		case "PUT":
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			data[hash] = b
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func TestHTTP_RoundTrip(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	c := &HTTP{BaseURL: srv.URL}
+
+	if ok, err := c.Contains("deadbeef"); err != nil || ok {
+		t.Fatalf("Contains() before Put = (%v, %v), want (false, nil)", ok, err)
+	}
+	if _, ok, err := c.Get("deadbeef"); err != nil || ok {
+		t.Fatalf("Get() before Put = (_, %v, %v), want (_, false, nil)", ok, err)
+	}
+
+	if err := c.Put("deadbeef", strings.NewReader("hello")); err != nil {
+		t.Fatalf("Put() error = %s", err)
+	}
+
+	if ok, err := c.Contains("deadbeef"); err != nil || !ok {
+		t.Fatalf("Contains() after Put = (%v, %v), want (true, nil)", ok, err)
+	}
+
+	r, ok, err := c.Get("deadbeef")
+	if err != nil || !ok {
+		t.Fatalf("Get() after Put = (_, %v, %v), want (_, true, nil)", ok, err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading Get() result: %s", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("Get() content = %q, want %q", got, "hello")
+	}
+}
+
+func TestHTTP_Location(t *testing.T) {
+	c := &HTTP{BaseURL: "https://cache.example.com/srclib"}
+	if got := c.Location(); got != c.BaseURL {
+		t.Errorf("Location() = %q, want %q", got, c.BaseURL)
+	}
+}
@@ -0,0 +1,55 @@
+package remotecache
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// InMemory is a RemoteCache backed by an in-process map. It is meant for
+// tests and for single-process tools that want remote-cache semantics
+// without standing up a server.
+type InMemory struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// NewInMemory returns an empty InMemory cache.
+func NewInMemory() *InMemory {
+	return &InMemory{data: make(map[string][]byte)}
+}
+
+func (c *InMemory) Get(hash string) (io.ReadCloser, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	b, ok := c.data[hash]
+	if !ok {
+		return nil, false, nil
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), true, nil
+}
+
+func (c *InMemory) Put(hash string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[hash] = b
+	return nil
+}
+
+func (c *InMemory) Contains(hash string) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.data[hash]
+	return ok, nil
+}
+
+// Location always returns "": an InMemory cache is private to this
+// process and has no address a spawned subprocess could use to reach it.
+func (c *InMemory) Location() string {
+	return ""
+}
@@ -0,0 +1,45 @@
+package remotecache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestInMemory_RoundTrip(t *testing.T) {
+	c := NewInMemory()
+
+	if ok, err := c.Contains("deadbeef"); err != nil || ok {
+		t.Fatalf("Contains() on empty cache = (%v, %v), want (false, nil)", ok, err)
+	}
+	if _, ok, err := c.Get("deadbeef"); err != nil || ok {
+		t.Fatalf("Get() on empty cache = (_, %v, %v), want (_, false, nil)", ok, err)
+	}
+
+	if err := c.Put("deadbeef", bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatalf("Put() error = %s", err)
+	}
+
+	if ok, err := c.Contains("deadbeef"); err != nil || !ok {
+		t.Fatalf("Contains() after Put = (%v, %v), want (true, nil)", ok, err)
+	}
+
+	r, ok, err := c.Get("deadbeef")
+	if err != nil || !ok {
+		t.Fatalf("Get() after Put = (_, %v, %v), want (_, true, nil)", ok, err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading Get() result: %s", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("Get() content = %q, want %q", got, "hello")
+	}
+}
+
+func TestInMemory_Location(t *testing.T) {
+	if loc := NewInMemory().Location(); loc != "" {
+		t.Errorf("Location() = %q, want empty string (InMemory has no reachable address)", loc)
+	}
+}
@@ -0,0 +1,57 @@
+package plan
+
+import (
+	"strings"
+	"testing"
+
+	"sourcegraph.com/sourcegraph/rwvfs"
+)
+
+func TestRemoteCachedRule_Recipes(t *testing.T) {
+	r := &remoteCachedRule{
+		hash:     "deadbeef",
+		location: "https://cache.example.com",
+		target:   "build/out.json",
+		vfs:      rwvfs.Map(map[string]string{}),
+	}
+
+	recipes := r.Recipes()
+	if len(recipes) != 2 {
+		t.Fatalf("Recipes() = %v, want 2 recipes (fetch + promote into local CAS)", recipes)
+	}
+	if !strings.Contains(recipes[0], "src cache fetch") || !strings.Contains(recipes[0], r.hash) || !strings.Contains(recipes[0], r.target) {
+		t.Errorf("Recipes()[0] = %q, want a 'src cache fetch' of %s into %s", recipes[0], r.hash, r.target)
+	}
+	if !strings.Contains(recipes[1], "src cache publish") || !strings.Contains(recipes[1], r.target) || !strings.Contains(recipes[1], casPath(r.hash)) {
+		t.Errorf("Recipes()[1] = %q, want a 'src cache publish' of %s into %s", recipes[1], r.target, casPath(r.hash))
+	}
+}
+
+func TestUploadingRule_Recipes(t *testing.T) {
+	inner := &fakeRule{target: "build/out.json", recipes: []string{"echo build"}}
+	r := &uploadingRule{Rule: inner, hash: "deadbeef", location: "https://cache.example.com"}
+
+	recipes := r.Recipes()
+	if len(recipes) != 2 {
+		t.Fatalf("Recipes() = %v, want the wrapped rule's recipe plus an upload recipe", recipes)
+	}
+	if recipes[0] != "echo build" {
+		t.Errorf("Recipes()[0] = %q, want the wrapped rule's own recipe unchanged", recipes[0])
+	}
+	if !strings.Contains(recipes[1], "src cache put") || !strings.Contains(recipes[1], r.hash) || !strings.Contains(recipes[1], r.location) {
+		t.Errorf("Recipes()[1] = %q, want a 'src cache put' of %s to %s", recipes[1], r.hash, r.location)
+	}
+}
+
+func TestCasPublishingRule_Recipes(t *testing.T) {
+	inner := &fakeRule{target: "build/out.json", recipes: []string{"echo build"}}
+	r := &casPublishingRule{Rule: inner, vfs: rwvfs.Map(map[string]string{}), hash: "deadbeef"}
+
+	recipes := r.Recipes()
+	if len(recipes) != 2 {
+		t.Fatalf("Recipes() = %v, want the wrapped rule's recipe plus a publish recipe", recipes)
+	}
+	if !strings.Contains(recipes[1], "src cache publish") || !strings.Contains(recipes[1], casPath(r.hash)) {
+		t.Errorf("Recipes()[1] = %q, want a publish into %s", recipes[1], casPath(r.hash))
+	}
+}
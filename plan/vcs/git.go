@@ -0,0 +1,116 @@
+package vcs
+
+import (
+	"fmt"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// gitRepo is a Repo backed by go-git, operating directly on the on-disk
+// object store rather than shelling out to `git` for every query.
+type gitRepo struct {
+	repo *git.Repository
+}
+
+func openGitRepo(dir string) (Repo, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, fmt.Errorf("vcs: opening git repo at %s: %s", dir, err)
+	}
+	return &gitRepo{repo: r}, nil
+}
+
+func (r *gitRepo) RevisionAncestors(head string, n int) ([]string, error) {
+	hash, err := r.resolve(head)
+	if err != nil {
+		return nil, err
+	}
+
+	cIter, err := r.repo.Log(&git.LogOptions{From: hash})
+	if err != nil {
+		return nil, err
+	}
+	defer cIter.Close()
+
+	var ancestors []string
+	skippedHead := false
+	err = cIter.ForEach(func(c *object.Commit) error {
+		if !skippedHead {
+			skippedHead = true
+			return nil
+		}
+		if len(ancestors) >= n {
+			return storer.ErrStop
+		}
+		ancestors = append(ancestors, c.Hash.String())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ancestors, nil
+}
+
+func (r *gitRepo) ChangedFiles(from, to string) ([]string, error) {
+	fromHash, err := r.resolve(from)
+	if err != nil {
+		return nil, err
+	}
+	toHash, err := r.resolve(to)
+	if err != nil {
+		return nil, err
+	}
+
+	fromCommit, err := r.repo.CommitObject(fromHash)
+	if err != nil {
+		return nil, err
+	}
+	toCommit, err := r.repo.CommitObject(toHash)
+	if err != nil {
+		return nil, err
+	}
+
+	fromTree, err := fromCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := toCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := fromTree.Diff(toTree)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(changes))
+	for _, c := range changes {
+		from, to := c.From, c.To
+		if to.Name != "" {
+			files = append(files, to.Name)
+		} else {
+			files = append(files, from.Name)
+		}
+	}
+	return files, nil
+}
+
+func (r *gitRepo) ResolveRef(ref string) (string, error) {
+	h, err := r.resolve(ref)
+	if err != nil {
+		return "", err
+	}
+	return h.String(), nil
+}
+
+func (r *gitRepo) resolve(ref string) (plumbing.Hash, error) {
+	h, err := r.repo.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("vcs: resolving %q: %s", ref, err)
+	}
+	return *h, nil
+}
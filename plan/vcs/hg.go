@@ -0,0 +1,78 @@
+package vcs
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// hgRepo is a Repo for Mercurial. Unlike gitRepo, it still shells out to
+// the hg binary for each query; Mercurial has no equivalent of go-git's
+// pure-Go object store access, and the hg command is assumed present on
+// any machine that analyzes Hg repos.
+type hgRepo struct {
+	dir string
+}
+
+func openHgRepo(dir string) (Repo, error) {
+	return &hgRepo{dir: dir}, nil
+}
+
+func (r *hgRepo) hg(args ...string) (string, error) {
+	cmd := exec.Command("hg", args...)
+	cmd.Dir = r.dir
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("vcs: hg %s: %s", strings.Join(args, " "), err)
+	}
+	return out.String(), nil
+}
+
+func (r *hgRepo) RevisionAncestors(head string, n int) ([]string, error) {
+	// sort(..., -rev) orders by revision number descending. Revision
+	// numbers increase monotonically as changesets are created, so this
+	// puts the most recently created ancestors first - the same
+	// nearest-to-furthest ordering RevisionAncestors promises and that
+	// gitRepo gets for free from git.Repository.Log's topological walk.
+	// It isn't a perfect topological distance (a changeset can be created
+	// later but merged in "further" from head than one created earlier),
+	// but it's the closest approximation available without walking the
+	// DAG by hand.
+	out, err := r.hg("log",
+		"-r", fmt.Sprintf("sort(ancestors(%s) - %s, -rev)", head, head),
+		"-l", strconv.Itoa(n),
+		"--template", "{node}\n")
+	if err != nil {
+		return nil, err
+	}
+	return splitNonEmptyLines(out), nil
+}
+
+func (r *hgRepo) ChangedFiles(from, to string) ([]string, error) {
+	out, err := r.hg("status", "--rev", from, "--rev", to, "-n")
+	if err != nil {
+		return nil, err
+	}
+	return splitNonEmptyLines(out), nil
+}
+
+func (r *hgRepo) ResolveRef(ref string) (string, error) {
+	out, err := r.hg("log", "-r", ref, "--template", "{node}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func splitNonEmptyLines(s string) []string {
+	var out []string
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
@@ -0,0 +1,36 @@
+// Package vcs provides a minimal, read-only view of a VCS repository's
+// revision history, used by the plan package to resolve cache-relevant
+// ancestry. The Git backend reads the object store directly; the
+// Mercurial backend runs the hg command for each lookup.
+package vcs
+
+import "fmt"
+
+// Repo is implemented by VCS-specific backends.
+type Repo interface {
+	// RevisionAncestors returns up to n ancestors of head, ordered from
+	// nearest to furthest, not including head itself. Callers (e.g.
+	// fallbackCachedRule) rely on this ordering to take the first
+	// ancestor with build data as the nearest one.
+	RevisionAncestors(head string, n int) ([]string, error)
+
+	// ChangedFiles returns the paths that differ between from and to.
+	ChangedFiles(from, to string) ([]string, error)
+
+	// ResolveRef resolves a ref (branch, tag, or partial commit ID) to a
+	// full commit ID.
+	ResolveRef(ref string) (string, error)
+}
+
+// Open opens the repository at dir, returning a Repo backed by an
+// appropriate implementation for vcsType ("git" or "hg").
+func Open(vcsType, dir string) (Repo, error) {
+	switch vcsType {
+	case "git":
+		return openGitRepo(dir)
+	case "hg":
+		return openHgRepo(dir)
+	default:
+		return nil, fmt.Errorf("vcs: unsupported VCS type %q", vcsType)
+	}
+}
@@ -0,0 +1,185 @@
+package plan
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"sourcegraph.com/sourcegraph/srclib/buildstore"
+	"sourcegraph.com/sourcegraph/srclib/config"
+)
+
+// watchDebounce is how long Watch waits after the last filesystem event
+// in a burst before re-analyzing, so that a save that touches several
+// files (or a git checkout) triggers one rebuild instead of many.
+const watchDebounce = 300 * time.Millisecond
+
+// WatchEvent reports the outcome of a rebuild triggered by a filesystem
+// change, for editor integrations that want to display live graph/def
+// updates without the developer re-invoking `src`.
+type WatchEvent struct {
+	Target     string      `json:"target"`
+	Status     EventStatus `json:"status"`
+	DurationMs int64       `json:"durationMs"`
+}
+
+// Watch runs an initial CreateMakefile + build, then re-analyzes
+// whenever a file under opt.RepoDir changes. Rather than tracking
+// affected units itself, it relies on the content-addressable caching in
+// CreateMakefile: a changed file gives its unit a new input hash, so on
+// the next pass CreateMakefile regenerates only that unit's rule as a
+// build-and-publish rule (see casPublishingRule), while every unchanged
+// unit's rule still resolves to a cachedRule, which fetches its
+// already-published output instead of rerunning the toolchain. This by
+// itself only changes which recipe a rule has, not whether the Executor
+// actually runs it: it's Executor.runOne's own staleness check (target
+// already newer than all its prereqs) that makes re-running the full
+// rule set on every debounced batch actually cheap, by skipping the
+// fetch recipe for every unaffected unit's cachedRule instead of
+// re-invoking it as a subprocess.
+//
+// Each rebuild runs in its own goroutine so that fsnotify events
+// continue to be drained (and coalesced into the next rebuild) while one
+// is in progress, instead of blocking the watcher and dropping events
+// that arrive mid-build. Watch returns once the initial build has
+// finished; the watching goroutine it starts runs until stop is closed
+// (or the watcher's channels close), and closes the returned channel
+// when it exits.
+func Watch(buildStore buildstore.RepoBuildStore, commitID, vcsType string, c *config.Tree, opt Options, stop <-chan struct{}) (<-chan WatchEvent, error) {
+	if opt.RepoDir == "" {
+		return nil, fmt.Errorf("plan: Watch requires opt.RepoDir")
+	}
+
+	if err := build(buildStore, commitID, vcsType, c, opt, nil); err != nil {
+		return nil, err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := addTreeDirs(w, opt.RepoDir); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	events := make(chan WatchEvent, 16)
+	go func() {
+		defer w.Close()
+		defer close(events)
+
+		debounce := time.NewTimer(watchDebounce)
+		if !debounce.Stop() {
+			<-debounce.C
+		}
+		pending := false
+
+		// building and buildDone track an in-flight rebuild, run in its
+		// own goroutine so this loop keeps draining w.Events/w.Errors
+		// while it runs. Without this, a rebuild that takes longer than
+		// fsnotify's event buffer needs to fill would block the watcher
+		// and silently drop the filesystem events that arrive mid-build.
+		building := false
+		buildDone := make(chan error, 1)
+		startBuild := func() {
+			building = true
+			go func() {
+				buildDone <- build(buildStore, commitID, vcsType, c, opt, events)
+			}()
+		}
+
+		for {
+			select {
+			case <-stop:
+				// If a build is in flight, its goroutine still holds a
+				// reference to events and will call the Progress callback
+				// (events <- WatchEvent{...}) until build() returns. Wait
+				// for it before returning, so the deferred close(events)
+				// above doesn't run while that send is still possible -
+				// closing a channel out from under a pending send panics
+				// the whole process.
+				if building {
+					<-buildDone
+				}
+				return
+
+			case _, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				pending = true
+				debounce.Reset(watchDebounce)
+
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("plan: watch error: %s", err)
+
+			case <-debounce.C:
+				if !pending || building {
+					continue
+				}
+				pending = false
+				startBuild()
+
+			case err := <-buildDone:
+				building = false
+				if err != nil {
+					log.Printf("plan: rebuild failed: %s", err)
+				}
+				// Events that arrived while this build was running are
+				// already reflected in pending; start the next build
+				// immediately instead of waiting for another debounce.
+				if pending {
+					pending = false
+					startBuild()
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// build runs one CreateMakefile + Executor pass, forwarding each rule's
+// completion as a WatchEvent on events (if non-nil).
+func build(buildStore buildstore.RepoBuildStore, commitID, vcsType string, c *config.Tree, opt Options, events chan<- WatchEvent) error {
+	mf, err := CreateMakefile(buildStore, commitID, vcsType, c, opt)
+	if err != nil {
+		return err
+	}
+
+	execOpt := ExecOptions{}
+	if events != nil {
+		execOpt.Progress = func(ev Event) {
+			if ev.Status == EventStart {
+				return
+			}
+			events <- WatchEvent{Target: ev.Target, Status: ev.Status, DurationMs: ev.Duration.Nanoseconds() / 1e6}
+		}
+	}
+
+	return NewExecutor(mf.Rules, execOpt).Run()
+}
+
+// addTreeDirs adds dir and all of its subdirectories to w. fsnotify only
+// watches the directories it's explicitly told about, not their
+// descendants.
+func addTreeDirs(w *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if info.Name() == ".git" || info.Name() == ".hg" || info.Name() == buildstore.BuildDataDirName {
+			return filepath.SkipDir
+		}
+		return w.Add(path)
+	})
+}